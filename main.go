@@ -2,225 +2,197 @@ package main
 
 import (
 	"bufio"
-	"errors"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
-	"regexp"
-	"sort"
-	"strconv"
 	"strings"
 	"text/tabwriter"
 
-	"github.com/zeebo/errs"
+	"github.com/zeebo/stack-clean/stack"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "serve" {
+		runServe(os.Args[2:])
+		return
+	}
+
 	printErrors := flag.Bool("e", false, "print errors")
 	filterCount := flag.Int("c", 0, "remove stacks with count less than this")
+	nameArgs := flag.Bool("name-args", false, "name recurring pointer-like args to collapse near-identical stacks")
+	jsonOutput := flag.Bool("json", false, "emit each bucket as a JSON object per line")
+	shortPaths := flag.Bool("short", false, "shorten frame paths under GOROOT or the module cache instead of using the bare filename; other paths are printed in full")
+	source := flag.Bool("source", false, "print the source line under each frame, when the file is readable on disk")
+	diffPath := flag.String("diff", "", "compare against another dump, printing added/removed/count-changed buckets")
 	flag.Parse()
 
-	var lines []string
-	var stacks []parsedStack
-	var errors int
-
-	addLines := func() {
-		if ps, err := parseStack(lines); err == nil {
-			stacks = append(stacks, ps)
-		} else {
-			errors++
-		}
-		lines = lines[:0]
+	snap, buckets, err := loadBuckets(os.Stdin, *nameArgs, *filterCount)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
 	}
 
-	scanner := bufio.NewScanner(os.Stdin)
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-		if line == "" {
-			addLines()
-			continue
+	if *diffPath != "" {
+		if *jsonOutput || *shortPaths || *source {
+			fmt.Fprintln(os.Stderr, "stack-clean: -diff cannot be combined with -json, -short, or -source")
+			os.Exit(1)
 		}
-		lines = append(lines, line)
-	}
-	addLines()
-
-	sort.Slice(stacks, func(i, j int) bool { return stacks[i].key < stacks[j].key })
 
-	group(stacks, func(n int, ps []parsedStack) {
-		if n < *filterCount {
-			return
+		f, err := os.Open(*diffPath)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
 		}
-		minWait, maxWait := minMax(ps)
-		fmt.Printf("count:%d waiting:%d-%d status:%s\n", n, minWait, maxWait, strings.Join(sortedStatuses(ps), ", "))
-		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
-		for _, f := range ps[0].frames {
-			fmt.Fprintf(tw, "%s:%d\t%s\n", filepath.Base(f.path), f.line, f.fn)
-		}
-		tw.Flush()
-		fmt.Println()
-	})
+		defer f.Close()
 
-	if *printErrors {
-		fmt.Printf("errors:%d\n", errors)
-	}
-}
+		_, oldBuckets, err := loadBuckets(f, *nameArgs, *filterCount)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
 
-func min(a, b int) int {
-	if a < b {
-		return a
+		printDiff(oldBuckets, buckets)
+		return
 	}
-	return b
-}
 
-func max(a, b int) int {
-	if a > b {
-		return a
+	if *jsonOutput {
+		printJSON(buckets)
+	} else {
+		var roots stack.Roots
+		if *shortPaths {
+			roots = snap.DetectRoots()
+			fmt.Printf("goroot:%s modcache:%s\n\n", roots.GOROOT, roots.ModCache)
+		}
+		printText(buckets, roots, *shortPaths, *source)
 	}
-	return b
-}
 
-func minMax(ps []parsedStack) (minWait, maxWait int) {
-	minWait, maxWait = ps[0].waiting, ps[0].waiting
-	for _, p := range ps[1:] {
-		minWait = min(minWait, p.waiting)
-		maxWait = max(maxWait, p.waiting)
+	if *printErrors {
+		fmt.Printf("errors:%d\n", snap.Errors)
 	}
-	return minWait, maxWait
 }
 
-func sortedStatuses(ps []parsedStack) []string {
-	ss := make(map[string]struct{})
-	for _, p := range ps {
-		ss[p.status] = struct{}{}
+func loadBuckets(r io.Reader, nameArgs bool, filterCount int) (*stack.Snapshot, []stack.Bucket, error) {
+	// WithStream echoes non-stack input (e.g. log lines mixed in with the
+	// traceback) to stderr instead of silently dropping it.
+	snap, err := stack.ParseDump(r, stack.WithStream(os.Stderr))
+	if err != nil {
+		return nil, nil, err
 	}
-	statuses := make([]string, 0, len(ss))
-	for s := range ss {
-		statuses = append(statuses, s)
+	if nameArgs {
+		snap.NameArgs()
 	}
-	sort.Strings(statuses)
-	return statuses
+	return snap, snap.Aggregate(stack.AggregateOptions{MinCount: filterCount}), nil
 }
 
-func group(ps []parsedStack, cb func(n int, ps []parsedStack)) {
-	if len(ps) == 0 {
-		return
+func printText(buckets []stack.Bucket, roots stack.Roots, short, source bool) {
+	for _, b := range buckets {
+		fmt.Printf("count:%d waiting:%d-%d status:%s\n", b.Count, b.MinWaiting, b.MaxWaiting, strings.Join(b.States, ", "))
+		printFrames(os.Stdout, b.Stack, roots, short, source)
+		fmt.Println()
 	}
+}
 
-	prev := 0
-	count := 1
-	for i := 1; i < len(ps); i++ {
-		if ps[i].key == ps[prev].key {
-			count++
-			continue
+func printFrames(w io.Writer, frames []stack.Frame, roots stack.Roots, short, source bool) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, f := range frames {
+		path := filepath.Base(f.Path)
+		if short {
+			path = stack.Shorten(f.Path, roots)
+		}
+		fmt.Fprintf(tw, "%s:%d\t%s\n", path, f.Line, f.Func)
+		if source {
+			if line, ok := readSourceLine(f.Path, f.Line); ok {
+				fmt.Fprintf(tw, "\t%s\n", line)
+			}
 		}
-
-		cb(count, ps[prev:i])
-		prev = i
-		count = 1
 	}
-	cb(count, ps[prev:])
-}
-
-type frame struct {
-	fn     string
-	args   string
-	path   string
-	line   int
-	offset uintptr
+	tw.Flush()
 }
 
-type parsedStack struct {
-	goroutine int
-	status    string
-	waiting   int
-
-	frames  []frame
-	created frame
-
-	key string
-}
+func printDiff(old, new []stack.Bucket) {
+	added, removed, changed := stack.Diff(old, new)
 
-var (
-	goroutineMatcher = regexp.MustCompile(`^goroutine (\d+) \[([^,]+)(, (\d+) minutes)?\]:$`)
-	createdMatcher   = regexp.MustCompile(`^created by (.+) in goroutine (\d+)$`)
-	locationMatcher  = regexp.MustCompile(`^(.+):(\d+)( \+(0x[0-9a-f]+))?$`)
-	functionMatcher  = regexp.MustCompile(`^(.+)\((.*)\)$`)
-)
-
-func parseStack(lines []string) (ps parsedStack, err error) {
-	if len(lines) < 3 {
-		return ps, errors.New("not enough lines")
+	for _, b := range added {
+		fmt.Printf("+ count:%d status:%s\n", b.Count, strings.Join(b.States, ", "))
+		printFrames(os.Stdout, b.Stack, stack.Roots{}, false, false)
+		fmt.Println()
 	}
-
-	var p parser
-
-	matches := p.regexp(lines[0], goroutineMatcher)
-	ps.goroutine = int(p.digits(matches[1]))
-	ps.status = matches[2]
-	ps.waiting = int(p.digits(matches[4]))
-
-	if lines[len(lines)-2] == "main.main()" {
-		ps.created.fn = "-"
-	} else {
-		matches = p.regexp(lines[len(lines)-2], createdMatcher)
-		ps.created.fn = matches[1]
+	for _, b := range removed {
+		fmt.Printf("- count:%d status:%s\n", b.Count, strings.Join(b.States, ", "))
+		printFrames(os.Stdout, b.Stack, stack.Roots{}, false, false)
+		fmt.Println()
 	}
+	for _, c := range changed {
+		fmt.Printf("~ count:%d->%d status:%s\n", c.OldCount, c.NewCount, strings.Join(c.Bucket.States, ", "))
+		printFrames(os.Stdout, c.Bucket.Stack, stack.Roots{}, false, false)
+		fmt.Println()
+	}
+}
 
-	matches = p.regexp(lines[len(lines)-1], locationMatcher)
-	ps.created.path = matches[1]
-	ps.created.line = int(p.digits(matches[2]))
-	ps.created.offset = uintptr(p.digits(matches[4]))
-
-	for i := 1; i < len(lines)-2; i += 2 {
-		var f frame
-
-		matches = p.regexp(lines[i], functionMatcher)
-		f.fn = matches[1]
-		f.args = matches[2]
-
-		matches = p.regexp(lines[i+1], locationMatcher)
-		f.path = matches[1]
-		f.line = int(p.digits(matches[2]))
-		f.offset = uintptr(p.digits(matches[4]))
-
-		ps.frames = append(ps.frames, f)
+func readSourceLine(path string, line int) (string, bool) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", false
 	}
+	defer f.Close()
 
-	var b strings.Builder
-	b.WriteString(ps.status)
-	b.WriteByte('\n')
-	for _, f := range ps.frames {
-		b.WriteString(f.fn)
-		b.WriteByte('\n')
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		if n == line {
+			return strings.TrimSpace(scanner.Text()), true
+		}
 	}
-	ps.key = b.String()
+	return "", false
+}
 
-	return ps, p.err
+type jsonFrame struct {
+	Func   string  `json:"fn"`
+	Args   string  `json:"args"`
+	File   string  `json:"file"`
+	Line   int     `json:"line"`
+	Offset uintptr `json:"offset"`
 }
 
-type parser struct {
-	err error
+type jsonBucket struct {
+	Count      int         `json:"count"`
+	MinWaiting int         `json:"min_waiting"`
+	MaxWaiting int         `json:"max_waiting"`
+	Statuses   []string    `json:"statuses"`
+	Stack      []jsonFrame `json:"stack"`
+	CreatedBy  jsonFrame   `json:"created_by"`
+	Goroutines []int       `json:"goroutines"`
 }
 
-func (p *parser) digits(s string) (n uint64) {
-	if p.err != nil {
-		return 0
-	} else if s == "" {
-		return 0
+func printJSON(buckets []stack.Bucket) {
+	enc := json.NewEncoder(os.Stdout)
+	for _, b := range buckets {
+		jb := jsonBucket{
+			Count:      b.Count,
+			MinWaiting: b.MinWaiting,
+			MaxWaiting: b.MaxWaiting,
+			Statuses:   b.States,
+			CreatedBy:  toJSONFrame(b.Created),
+			Goroutines: b.IDs,
+		}
+		for _, f := range b.Stack {
+			jb.Stack = append(jb.Stack, toJSONFrame(f))
+		}
+		if err := enc.Encode(jb); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
 	}
-	n, p.err = strconv.ParseUint(s, 0, 64)
-	return n
 }
 
-func (p *parser) regexp(s string, re *regexp.Regexp) (matches []string) {
-	if p.err != nil {
-		return make([]string, re.NumSubexp()+1)
-	}
-	matches = re.FindStringSubmatch(s)
-	if matches == nil {
-		p.err = errs.New("no match: %q (%v)", s, re)
-		return make([]string, re.NumSubexp()+1)
+func toJSONFrame(f stack.Frame) jsonFrame {
+	return jsonFrame{
+		Func:   f.Func,
+		Args:   f.Args,
+		File:   f.Path,
+		Line:   f.Line,
+		Offset: f.Offset,
 	}
-	return matches
 }
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zeebo/stack-clean/stack"
+)
+
+// runServe implements the "serve" subcommand: it periodically fetches a
+// goroutine dump from a target URL (typically
+// /debug/pprof/goroutine?debug=2 on a running service), runs it through the
+// usual parse/aggregate pipeline, and serves the result as a collapsible
+// HTML page and a /json endpoint.
+func runServe(args []string) {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	addr := fs.String("addr", ":8080", "address to serve the HTML/JSON views on")
+	target := fs.String("target", "", "URL to fetch a goroutine dump from, e.g. http://host:6060/debug/pprof/goroutine?debug=2")
+	refresh := fs.Duration("refresh", 10*time.Second, "how often to refetch the target dump")
+	historyLen := fs.Int("history", 10, "number of past snapshots to keep in memory")
+	fs.Parse(args)
+
+	if *target == "" {
+		fmt.Fprintln(os.Stderr, "serve: -target is required")
+		os.Exit(1)
+	}
+	if *refresh <= 0 {
+		fmt.Fprintln(os.Stderr, "serve: -refresh must be positive")
+		os.Exit(1)
+	}
+	if *historyLen < 1 {
+		fmt.Fprintln(os.Stderr, "serve: -history must be at least 1")
+		os.Exit(1)
+	}
+
+	srv := &server{target: *target, historyLen: *historyLen, client: &http.Client{Timeout: *refresh}}
+	srv.fetch()
+
+	go func() {
+		t := time.NewTicker(*refresh)
+		defer t.Stop()
+		for range t.C {
+			srv.fetch()
+		}
+	}()
+
+	http.HandleFunc("/", srv.handleIndex)
+	http.HandleFunc("/json", srv.handleJSON)
+
+	log.Fatal(http.ListenAndServe(*addr, nil))
+}
+
+// snapshotEntry's fields are exported so it can be range'd over directly
+// from the index HTML template.
+type snapshotEntry struct {
+	At      time.Time
+	Buckets []stack.Bucket
+}
+
+type server struct {
+	target     string
+	historyLen int
+	client     *http.Client
+
+	mu    sync.Mutex
+	snaps []snapshotEntry
+}
+
+func (s *server) fetch() {
+	resp, err := s.client.Get(s.target)
+	if err != nil {
+		log.Printf("serve: fetch %s: %v", s.target, err)
+		return
+	}
+	defer resp.Body.Close()
+
+	snap, err := stack.ParseDump(resp.Body)
+	if err != nil {
+		log.Printf("serve: parse dump from %s: %v", s.target, err)
+		return
+	}
+
+	buckets := snap.Aggregate(stack.AggregateOptions{})
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i].Count > buckets[j].Count })
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.snaps = append(s.snaps, snapshotEntry{At: time.Now(), Buckets: buckets})
+	if len(s.snaps) > s.historyLen {
+		s.snaps = s.snaps[len(s.snaps)-s.historyLen:]
+	}
+}
+
+// at returns the snapshot requested by the "n" query parameter (an index
+// into the in-memory history, 0-based and oldest-first), defaulting to the
+// most recent one.
+func (s *server) at(r *http.Request) (snapshotEntry, int, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.snaps) == 0 {
+		return snapshotEntry{}, 0, false
+	}
+
+	n := len(s.snaps) - 1
+	if v := r.URL.Query().Get("n"); v != "" {
+		if parsed, err := strconv.Atoi(v); err == nil && parsed >= 0 && parsed < len(s.snaps) {
+			n = parsed
+		}
+	}
+	return s.snaps[n], n, true
+}
+
+func (s *server) handleJSON(w http.ResponseWriter, r *http.Request) {
+	entry, _, ok := s.at(r)
+	if !ok {
+		http.Error(w, "no snapshot available yet", http.StatusServiceUnavailable)
+		return
+	}
+
+	jbs := make([]jsonBucket, 0, len(entry.Buckets))
+	for _, b := range entry.Buckets {
+		jb := jsonBucket{
+			Count:      b.Count,
+			MinWaiting: b.MinWaiting,
+			MaxWaiting: b.MaxWaiting,
+			Statuses:   b.States,
+			CreatedBy:  toJSONFrame(b.Created),
+			Goroutines: b.IDs,
+		}
+		for _, f := range b.Stack {
+			jb.Stack = append(jb.Stack, toJSONFrame(f))
+		}
+		jbs = append(jbs, jb)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(jbs); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+var indexTmpl = template.Must(template.New("index").Funcs(template.FuncMap{
+	"join": func(ss []string) string { return strings.Join(ss, ", ") },
+}).Parse(`<!doctype html>
+<html>
+<head><title>stack-clean serve</title></head>
+<body>
+<h1>goroutine buckets</h1>
+<p>
+{{range $i, $s := .Snaps}}{{if eq $i $.Current}}<b>{{$s.At.Format "15:04:05"}}</b>{{else}}<a href="/?n={{$i}}">{{$s.At.Format "15:04:05"}}</a>{{end}} {{end}}
+</p>
+<p>{{len .Buckets}} buckets from {{.Target}}, captured {{.At.Format "15:04:05"}}</p>
+{{range .Buckets}}
+<details>
+<summary>count:{{.Count}} waiting:{{.MinWaiting}}-{{.MaxWaiting}} status:{{join .States}}</summary>
+<pre>{{range .Stack}}{{.Path}}:{{.Line}} {{.Func}}
+{{end}}</pre>
+</details>
+{{end}}
+</body>
+</html>
+`))
+
+func (s *server) handleIndex(w http.ResponseWriter, r *http.Request) {
+	entry, n, ok := s.at(r)
+	if !ok {
+		http.Error(w, "no snapshot available yet", http.StatusServiceUnavailable)
+		return
+	}
+
+	s.mu.Lock()
+	snaps := append([]snapshotEntry(nil), s.snaps...)
+	s.mu.Unlock()
+
+	data := struct {
+		Target  string
+		At      time.Time
+		Buckets []stack.Bucket
+		Snaps   []snapshotEntry
+		Current int
+	}{
+		Target:  s.target,
+		At:      entry.At,
+		Buckets: entry.Buckets,
+		Snaps:   snaps,
+		Current: n,
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := indexTmpl.Execute(w, data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
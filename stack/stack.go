@@ -0,0 +1,559 @@
+// Package stack parses and aggregates goroutine dumps produced by
+// runtime.Stack (e.g. SIGQUIT output or /debug/pprof/goroutine?debug=2).
+// It is split out of the stack-clean CLI so other tools can reuse the
+// parsing and grouping without shelling out to the binary.
+package stack
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/zeebo/errs"
+)
+
+// Frame is a single entry in a goroutine's call stack.
+type Frame struct {
+	Func   string
+	Args   string
+	Path   string
+	Line   int
+	Offset uintptr
+}
+
+// Goroutine is a single parsed "goroutine N [...]:" block.
+type Goroutine struct {
+	ID             int
+	State          string
+	States         []string
+	Waiting        int
+	LockedToThread bool
+	Unavailable    bool
+	Elided         int
+
+	Frames  []Frame
+	Created Frame
+
+	key string
+}
+
+// Snapshot is the result of parsing a full dump.
+type Snapshot struct {
+	Goroutines []Goroutine
+
+	// Errors counts blocks that could not be parsed as a goroutine stack.
+	Errors int
+}
+
+// Option configures ParseDump.
+type Option func(*options)
+
+type options struct {
+	stream io.Writer
+}
+
+// WithStream causes lines that are not part of a goroutine stack block to be
+// written to w as they are encountered, so mixed log+traceback input can be
+// passed through a caller-supplied writer instead of being discarded.
+func WithStream(w io.Writer) Option {
+	return func(o *options) { o.stream = w }
+}
+
+var headerPrefix = regexp.MustCompile(`^goroutine \d+ \[`)
+
+// ParseDump reads a goroutine dump from r and returns the parsed snapshot.
+func ParseDump(r io.Reader, opts ...Option) (*Snapshot, error) {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	snap := &Snapshot{}
+
+	var lines []string
+	flush := func() {
+		if len(lines) == 0 {
+			return
+		}
+		if g, err := parseGoroutine(lines); err == nil {
+			snap.Goroutines = append(snap.Goroutines, g)
+		} else {
+			snap.Errors++
+		}
+		lines = lines[:0]
+	}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "" && len(lines) == 0:
+			if o.stream != nil {
+				fmt.Fprintln(o.stream, line)
+			}
+		case line == "":
+			flush()
+		case len(lines) == 0 && !headerPrefix.MatchString(line):
+			if o.stream != nil {
+				fmt.Fprintln(o.stream, line)
+			}
+		default:
+			lines = append(lines, line)
+		}
+	}
+	flush()
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(snap.Goroutines, func(i, j int) bool { return snap.Goroutines[i].key < snap.Goroutines[j].key })
+
+	return snap, nil
+}
+
+// Roots holds filesystem prefixes detected in (or supplied for) a dump,
+// used to shorten frame paths without losing package context the way
+// filepath.Base does.
+type Roots struct {
+	// GOROOT is the Go installation root, e.g. "/usr/local/go".
+	GOROOT string
+	// ModCache is the module cache root, e.g. "/home/user/go/pkg/mod/".
+	ModCache string
+	// Module is a caller-supplied main module root used to shorten paths
+	// to module-relative form. DetectRoots does not set this; it is only
+	// reliably known by the caller (e.g. the current module's directory).
+	Module string
+}
+
+// DetectRoots scans the snapshot's frame paths for the longest common
+// .../src/runtime/ and .../pkg/mod/ prefixes.
+func (s *Snapshot) DetectRoots() Roots {
+	var roots Roots
+	for _, g := range s.Goroutines {
+		for _, path := range g.paths() {
+			if i := strings.Index(path, "/src/runtime/"); i >= 0 {
+				root := path[:i]
+				if roots.GOROOT == "" || len(root) < len(roots.GOROOT) {
+					roots.GOROOT = root
+				}
+			}
+			if i := strings.Index(path, "/pkg/mod/"); i >= 0 {
+				root := path[:i+len("/pkg/mod/")]
+				if roots.ModCache == "" || len(root) < len(roots.ModCache) {
+					roots.ModCache = root
+				}
+			}
+		}
+	}
+	return roots
+}
+
+func (g Goroutine) paths() []string {
+	paths := make([]string, 0, len(g.Frames)+1)
+	for _, f := range g.Frames {
+		paths = append(paths, f.Path)
+	}
+	return append(paths, g.Created.Path)
+}
+
+// Shorten rewrites path to a short form using roots: a file under
+// roots.GOROOT becomes "$GOROOT/src/...", a file under roots.ModCache
+// becomes "mod@ver/...", and a file under roots.Module becomes
+// module-relative ("pkg/foo/bar.go"). A path matching none of the roots is
+// returned unchanged.
+func Shorten(path string, roots Roots) string {
+	switch {
+	case roots.GOROOT != "" && strings.HasPrefix(path, roots.GOROOT+"/src/"):
+		return "$GOROOT/src/" + strings.TrimPrefix(path, roots.GOROOT+"/src/")
+	case roots.ModCache != "" && strings.HasPrefix(path, roots.ModCache):
+		return strings.TrimPrefix(path, roots.ModCache)
+	case roots.Module != "" && strings.HasPrefix(path, roots.Module+"/"):
+		return strings.TrimPrefix(path, roots.Module+"/")
+	default:
+		return path
+	}
+}
+
+// AggregateOptions controls how Snapshot.Aggregate groups goroutines.
+type AggregateOptions struct {
+	// MinCount drops buckets with fewer than this many goroutines.
+	MinCount int
+}
+
+// Bucket is a group of goroutines that share an identical stack.
+type Bucket struct {
+	// Key identifies the bucket's stack shape and is stable across
+	// aggregations of different snapshots, so it can be used to match
+	// buckets up for Diff. After NameArgs the key also holds the "#N"
+	// placeholders, which are numbered per snapshot in first-seen order,
+	// so the same stack can get different keys in two snapshots.
+	Key string
+
+	Count      int
+	MinWaiting int
+	MaxWaiting int
+	States     []string
+
+	Stack   []Frame
+	Created Frame
+
+	IDs []int
+}
+
+// Aggregate groups the snapshot's goroutines by identical stacks.
+func (s *Snapshot) Aggregate(opts AggregateOptions) []Bucket {
+	var buckets []Bucket
+
+	group(s.Goroutines, func(n int, gs []Goroutine) {
+		if n < opts.MinCount {
+			return
+		}
+
+		b := Bucket{
+			Key:     gs[0].key,
+			Count:   n,
+			States:  sortedStates(gs),
+			Stack:   gs[0].Frames,
+			Created: gs[0].Created,
+		}
+		b.MinWaiting, b.MaxWaiting = minMaxWaiting(gs)
+		for _, g := range gs {
+			b.IDs = append(b.IDs, g.ID)
+		}
+
+		buckets = append(buckets, b)
+	})
+
+	return buckets
+}
+
+// CountChange is a bucket present in both aggregations whose count differs.
+type CountChange struct {
+	Bucket   Bucket
+	OldCount int
+	NewCount int
+}
+
+// Diff compares two aggregations, matching buckets by Key, and reports the
+// buckets added in new, removed from old, and present in both with a
+// different count. This is the basis of the -diff workflow: capture a
+// dump, wait, capture another, and see which stacks grew.
+func Diff(old, new []Bucket) (added, removed []Bucket, changed []CountChange) {
+	oldByKey := make(map[string]Bucket, len(old))
+	for _, b := range old {
+		oldByKey[b.Key] = b
+	}
+
+	for _, b := range new {
+		o, ok := oldByKey[b.Key]
+		switch {
+		case !ok:
+			added = append(added, b)
+		case o.Count != b.Count:
+			changed = append(changed, CountChange{Bucket: b, OldCount: o.Count, NewCount: b.Count})
+		}
+	}
+
+	newByKey := make(map[string]Bucket, len(new))
+	for _, b := range new {
+		newByKey[b.Key] = b
+	}
+	for _, b := range old {
+		if _, ok := newByKey[b.Key]; !ok {
+			removed = append(removed, b)
+		}
+	}
+
+	return added, removed, changed
+}
+
+// NameArgs scans the frame argument lists of every goroutine in the
+// snapshot for (function, argument position) slots that hold pointer-like
+// tokens (hex literals or bare numbers) in at least two goroutines, and
+// rewrites every nameable value occupying such a slot to the same
+// symbolic name, e.g. "#1", in first-seen order. This is a shared
+// placeholder per slot, not per distinct value, so 500 goroutines blocked
+// in the same function but holding 500 different pointer receivers still
+// normalize to one name for that argument. Each goroutine's grouping key
+// is then recomputed from its (now normalized) args, so those stacks
+// collapse into a single bucket; the default, non-name-args key ignores
+// args entirely and is unaffected.
+//
+// NameArgs makes two passes over the frames of all goroutines (one builds
+// the recurring slots and a second substitutes them) and then re-sorts the
+// goroutines by their new keys; call it only when requested, since it
+// touches every frame's args twice.
+func (s *Snapshot) NameArgs() {
+	type slot struct {
+		fn  string
+		idx int
+	}
+
+	counts := make(map[slot]int)
+	for _, g := range s.Goroutines {
+		seen := make(map[slot]bool)
+		for _, f := range g.Frames {
+			for idx, lit := range splitArgs(f.Args) {
+				k := slot{f.Func, idx}
+				if isNameableArg(lit) && !seen[k] {
+					seen[k] = true
+					counts[k]++
+				}
+			}
+		}
+	}
+
+	names := make(map[slot]string)
+	next := 1
+	nameFor := func(k slot) string {
+		if n, ok := names[k]; ok {
+			return n
+		}
+		if counts[k] < 2 {
+			return ""
+		}
+		n := fmt.Sprintf("#%d", next)
+		next++
+		names[k] = n
+		return n
+	}
+
+	for i := range s.Goroutines {
+		g := &s.Goroutines[i]
+		for j := range g.Frames {
+			f := &g.Frames[j]
+			toks := splitArgs(f.Args)
+			changed := false
+			for idx, lit := range toks {
+				if !isNameableArg(lit) {
+					continue
+				}
+				if n := nameFor(slot{f.Func, idx}); n != "" {
+					toks[idx] = n
+					changed = true
+				}
+			}
+			if changed {
+				f.Args = strings.Join(toks, ", ")
+			}
+		}
+		g.key = buildArgSensitiveKey(*g)
+	}
+
+	sort.Slice(s.Goroutines, func(i, j int) bool { return s.Goroutines[i].key < s.Goroutines[j].key })
+}
+
+var nameableArgMatcher = regexp.MustCompile(`^(0x[0-9a-f]+|\d+)$`)
+
+func isNameableArg(lit string) bool {
+	return nameableArgMatcher.MatchString(lit)
+}
+
+func splitArgs(args string) []string {
+	if args == "" {
+		return nil
+	}
+	toks := strings.Split(args, ", ")
+	for i, t := range toks {
+		toks[i] = strings.TrimSpace(t)
+	}
+	return toks
+}
+
+func minMaxWaiting(gs []Goroutine) (minWait, maxWait int) {
+	minWait, maxWait = gs[0].Waiting, gs[0].Waiting
+	for _, g := range gs[1:] {
+		minWait = min(minWait, g.Waiting)
+		maxWait = max(maxWait, g.Waiting)
+	}
+	return minWait, maxWait
+}
+
+func sortedStates(gs []Goroutine) []string {
+	ss := make(map[string]struct{})
+	for _, g := range gs {
+		ss[g.State] = struct{}{}
+	}
+	states := make([]string, 0, len(ss))
+	for s := range ss {
+		states = append(states, s)
+	}
+	sort.Strings(states)
+	return states
+}
+
+func group(gs []Goroutine, cb func(n int, gs []Goroutine)) {
+	if len(gs) == 0 {
+		return
+	}
+
+	prev := 0
+	count := 1
+	for i := 1; i < len(gs); i++ {
+		if gs[i].key == gs[prev].key {
+			count++
+			continue
+		}
+
+		cb(count, gs[prev:i])
+		prev = i
+		count = 1
+	}
+	cb(count, gs[prev:])
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+var (
+	goroutineMatcher = regexp.MustCompile(`^goroutine (\d+) \[(.+)\]:$`)
+	minutesMatcher   = regexp.MustCompile(`^(\d+) minutes$`)
+	elidedMatcher    = regexp.MustCompile(`^\.\.\.(\d+) frames elided\.\.\.$`)
+	createdMatcher   = regexp.MustCompile(`^created by (.+) in goroutine (\d+)$`)
+	locationMatcher  = regexp.MustCompile(`^(.+):(\d+)( \+(0x[0-9a-f]+))?$`)
+	functionMatcher  = regexp.MustCompile(`^(.+)\((.*)\)$`)
+)
+
+// unavailableMarker replaces a goroutine's frames when the runtime could not
+// unwind a stack running on another OS thread.
+const unavailableMarker = "goroutine running on other thread; stack unavailable"
+
+func parseGoroutine(lines []string) (g Goroutine, err error) {
+	if len(lines) < 3 {
+		return g, errors.New("not enough lines")
+	}
+
+	var p parser
+
+	matches := p.regexp(lines[0], goroutineMatcher)
+	g.ID = int(p.digits(matches[1]))
+
+	for i, tok := range strings.Split(matches[2], ", ") {
+		switch {
+		case tok == "locked to thread":
+			g.LockedToThread = true
+		case minutesMatcher.MatchString(tok):
+			g.Waiting = int(p.digits(minutesMatcher.FindStringSubmatch(tok)[1]))
+		default:
+			if i == 0 {
+				g.State = tok
+			}
+			g.States = append(g.States, tok)
+		}
+	}
+
+	if lines[len(lines)-2] == "main.main()" {
+		g.Created.Func = "-"
+	} else {
+		matches = p.regexp(lines[len(lines)-2], createdMatcher)
+		g.Created.Func = matches[1]
+	}
+
+	matches = p.regexp(lines[len(lines)-1], locationMatcher)
+	g.Created.Path = matches[1]
+	g.Created.Line = int(p.digits(matches[2]))
+	g.Created.Offset = uintptr(p.digits(matches[4]))
+
+	if lines[1] == unavailableMarker {
+		g.Unavailable = true
+	} else {
+		for i := 1; i < len(lines)-2; {
+			if elidedMatcher.MatchString(lines[i]) {
+				g.Elided += int(p.digits(elidedMatcher.FindStringSubmatch(lines[i])[1]))
+				i++
+				continue
+			}
+
+			var f Frame
+
+			matches = p.regexp(lines[i], functionMatcher)
+			f.Func = matches[1]
+			f.Args = matches[2]
+
+			matches = p.regexp(lines[i+1], locationMatcher)
+			f.Path = matches[1]
+			f.Line = int(p.digits(matches[2]))
+			f.Offset = uintptr(p.digits(matches[4]))
+
+			g.Frames = append(g.Frames, f)
+			i += 2
+		}
+	}
+
+	g.key = buildKey(g)
+
+	return g, p.err
+}
+
+// buildKey computes a goroutine's grouping key from its state, elision
+// count, and frame function names. Argument values are deliberately
+// excluded so that, by default, goroutines differ only by where they
+// are, not by what they were called with.
+func buildKey(g Goroutine) string {
+	var b strings.Builder
+	b.WriteString(g.State)
+	b.WriteByte('\n')
+	fmt.Fprintf(&b, "elided:%d\n", g.Elided)
+	for _, f := range g.Frames {
+		b.WriteString(f.Func)
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
+
+// buildArgSensitiveKey extends buildKey with each frame's argument list.
+// It is only used by NameArgs, after pointer-like args have been
+// normalized to shared placeholders, so that a stack's remaining
+// (non-pointer) argument differences still keep it in its own bucket.
+func buildArgSensitiveKey(g Goroutine) string {
+	var b strings.Builder
+	b.WriteString(buildKey(g))
+	for _, f := range g.Frames {
+		b.WriteString(f.Args)
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
+
+type parser struct {
+	err error
+}
+
+func (p *parser) digits(s string) (n uint64) {
+	if p.err != nil {
+		return 0
+	} else if s == "" {
+		return 0
+	}
+	n, p.err = strconv.ParseUint(s, 0, 64)
+	return n
+}
+
+func (p *parser) regexp(s string, re *regexp.Regexp) (matches []string) {
+	if p.err != nil {
+		return make([]string, re.NumSubexp()+1)
+	}
+	matches = re.FindStringSubmatch(s)
+	if matches == nil {
+		p.err = errs.New("no match: %q (%v)", s, re)
+		return make([]string, re.NumSubexp()+1)
+	}
+	return matches
+}
@@ -0,0 +1,244 @@
+package stack
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestParseDump_RichShapes(t *testing.T) {
+	const dump = `goroutine 1 [running]:
+main.main()
+	/tmp/src/main.go:10 +0x1
+
+goroutine 2 [chan receive, 5 minutes]:
+main.worker(0xc0001000)
+	/tmp/src/worker.go:22 +0x20
+created by main.main in goroutine 1
+	/tmp/src/main.go:15 +0x2
+
+goroutine 3 [syscall, locked to thread]:
+main.syscall1()
+	/tmp/src/sys.go:8 +0x3
+created by main.main in goroutine 1
+	/tmp/src/main.go:16 +0x2
+
+goroutine 4 [running]:
+goroutine running on other thread; stack unavailable
+created by main.main in goroutine 1
+	/tmp/src/main.go:17 +0x2
+
+goroutine 5 [running]:
+main.deep()
+	/tmp/src/deep.go:1 +0x1
+...5 frames elided...
+main.base()
+	/tmp/src/deep.go:99 +0x1
+created by main.main in goroutine 1
+	/tmp/src/main.go:18 +0x2
+`
+
+	snap, err := ParseDump(strings.NewReader(dump))
+	if err != nil {
+		t.Fatalf("ParseDump: %v", err)
+	}
+	if snap.Errors != 0 {
+		t.Fatalf("unexpected parse errors: %d", snap.Errors)
+	}
+	if len(snap.Goroutines) != 5 {
+		t.Fatalf("got %d goroutines, want 5", len(snap.Goroutines))
+	}
+
+	byID := make(map[int]Goroutine, len(snap.Goroutines))
+	for _, g := range snap.Goroutines {
+		byID[g.ID] = g
+	}
+
+	if g := byID[2]; g.Waiting != 5 {
+		t.Errorf("goroutine 2: Waiting = %d, want 5", g.Waiting)
+	}
+
+	if g := byID[3]; !g.LockedToThread {
+		t.Errorf("goroutine 3: LockedToThread = false, want true")
+	}
+
+	if g := byID[4]; !g.Unavailable || len(g.Frames) != 0 {
+		t.Errorf("goroutine 4: Unavailable = %v, len(Frames) = %d, want true, 0", g.Unavailable, len(g.Frames))
+	}
+
+	if g := byID[5]; g.Elided != 5 || len(g.Frames) != 2 {
+		t.Errorf("goroutine 5: Elided = %d, len(Frames) = %d, want 5, 2", g.Elided, len(g.Frames))
+	}
+}
+
+func distinctPointerDump(n int) string {
+	var b strings.Builder
+	for i := 1; i <= n; i++ {
+		fmt.Fprintf(&b, "goroutine %d [chan receive]:\n", i)
+		fmt.Fprintf(&b, "main.worker(0xc%04d000)\n", i)
+		b.WriteString("\t/tmp/src/worker.go:22 +0x20\n")
+		b.WriteString("created by main.main in goroutine 1\n")
+		b.WriteString("\t/tmp/src/main.go:15 +0x2\n\n")
+	}
+	return b.String()
+}
+
+func TestAggregate_DefaultIgnoresArgs(t *testing.T) {
+	snap, err := ParseDump(strings.NewReader(distinctPointerDump(5)))
+	if err != nil {
+		t.Fatalf("ParseDump: %v", err)
+	}
+
+	buckets := snap.Aggregate(AggregateOptions{})
+	if len(buckets) != 1 || buckets[0].Count != 5 {
+		t.Fatalf("got %d buckets (first count %d), want 1 bucket with count 5", len(buckets), firstCount(buckets))
+	}
+}
+
+func TestNameArgs_CollapsesDistinctPointerSlots(t *testing.T) {
+	snap, err := ParseDump(strings.NewReader(distinctPointerDump(5)))
+	if err != nil {
+		t.Fatalf("ParseDump: %v", err)
+	}
+
+	snap.NameArgs()
+	buckets := snap.Aggregate(AggregateOptions{})
+	if len(buckets) != 1 || buckets[0].Count != 5 {
+		t.Fatalf("got %d buckets (first count %d), want 1 bucket with count 5", len(buckets), firstCount(buckets))
+	}
+
+	for _, f := range buckets[0].Stack {
+		if f.Args != "#1" {
+			t.Errorf("frame %s: Args = %q, want normalized placeholder \"#1\"", f.Func, f.Args)
+		}
+	}
+}
+
+func TestNameArgs_LeavesOneOffArgsAlone(t *testing.T) {
+	const dump = `goroutine 1 [running]:
+main.worker(0xc0001000)
+	/tmp/src/worker.go:22 +0x20
+created by main.main in goroutine 1
+	/tmp/src/main.go:15 +0x2
+`
+	snap, err := ParseDump(strings.NewReader(dump))
+	if err != nil {
+		t.Fatalf("ParseDump: %v", err)
+	}
+
+	snap.NameArgs()
+	if got := snap.Goroutines[0].Frames[0].Args; got != "0xc0001000" {
+		t.Errorf("Args = %q, want unchanged (no other goroutine shares this slot)", got)
+	}
+}
+
+func firstCount(bs []Bucket) int {
+	if len(bs) == 0 {
+		return 0
+	}
+	return bs[0].Count
+}
+
+func TestParseDump_WithStreamPassesThroughBlankLines(t *testing.T) {
+	const input = "log line 1\n\nlog line 2\n"
+
+	var sb strings.Builder
+	if _, err := ParseDump(strings.NewReader(input), WithStream(&sb)); err != nil {
+		t.Fatalf("ParseDump: %v", err)
+	}
+
+	if got := sb.String(); got != input {
+		t.Errorf("streamed = %q, want %q", got, input)
+	}
+}
+
+func TestDetectRootsAndShorten(t *testing.T) {
+	const dump = `goroutine 1 [running]:
+main.main()
+	/usr/local/go/src/runtime/proc.go:250 +0x1
+
+goroutine 2 [running]:
+main.worker()
+	/home/user/go/pkg/mod/github.com/foo/bar@v1.2.3/baz.go:10 +0x2
+created by main.main in goroutine 1
+	/usr/local/go/src/runtime/proc.go:250 +0x1
+`
+	snap, err := ParseDump(strings.NewReader(dump))
+	if err != nil {
+		t.Fatalf("ParseDump: %v", err)
+	}
+
+	roots := snap.DetectRoots()
+	if roots.GOROOT != "/usr/local/go" {
+		t.Errorf("GOROOT = %q, want /usr/local/go", roots.GOROOT)
+	}
+	if roots.ModCache != "/home/user/go/pkg/mod/" {
+		t.Errorf("ModCache = %q, want /home/user/go/pkg/mod/", roots.ModCache)
+	}
+
+	if got := Shorten("/usr/local/go/src/runtime/proc.go", roots); got != "$GOROOT/src/runtime/proc.go" {
+		t.Errorf("Shorten(runtime) = %q", got)
+	}
+	if got := Shorten("/home/user/go/pkg/mod/github.com/foo/bar@v1.2.3/baz.go", roots); got != "github.com/foo/bar@v1.2.3/baz.go" {
+		t.Errorf("Shorten(mod cache) = %q", got)
+	}
+	if got := Shorten("/elsewhere/main.go", roots); got != "/elsewhere/main.go" {
+		t.Errorf("Shorten(no match) = %q, want path unchanged", got)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	const oldDump = `goroutine 1 [chan receive]:
+main.same()
+	/tmp/src/a.go:1 +0x1
+created by main.main in goroutine 1
+	/tmp/src/main.go:1 +0x1
+
+goroutine 2 [chan receive]:
+main.same()
+	/tmp/src/a.go:1 +0x1
+created by main.main in goroutine 1
+	/tmp/src/main.go:1 +0x1
+
+goroutine 3 [running]:
+main.removed()
+	/tmp/src/b.go:1 +0x1
+created by main.main in goroutine 1
+	/tmp/src/main.go:2 +0x1
+`
+	const newDump = `goroutine 1 [chan receive]:
+main.same()
+	/tmp/src/a.go:1 +0x1
+created by main.main in goroutine 1
+	/tmp/src/main.go:1 +0x1
+
+goroutine 4 [syscall]:
+main.added()
+	/tmp/src/c.go:1 +0x1
+created by main.main in goroutine 1
+	/tmp/src/main.go:3 +0x1
+`
+	oldSnap, err := ParseDump(strings.NewReader(oldDump))
+	if err != nil {
+		t.Fatalf("ParseDump(old): %v", err)
+	}
+	newSnap, err := ParseDump(strings.NewReader(newDump))
+	if err != nil {
+		t.Fatalf("ParseDump(new): %v", err)
+	}
+
+	oldBuckets := oldSnap.Aggregate(AggregateOptions{})
+	newBuckets := newSnap.Aggregate(AggregateOptions{})
+
+	added, removed, changed := Diff(oldBuckets, newBuckets)
+
+	if len(added) != 1 || added[0].Stack[0].Func != "main.added" {
+		t.Errorf("added = %+v, want one bucket for main.added", added)
+	}
+	if len(removed) != 1 || removed[0].Stack[0].Func != "main.removed" {
+		t.Errorf("removed = %+v, want one bucket for main.removed", removed)
+	}
+	if len(changed) != 1 || changed[0].OldCount != 2 || changed[0].NewCount != 1 {
+		t.Errorf("changed = %+v, want one entry 2 -> 1", changed)
+	}
+}